@@ -3,14 +3,17 @@
 // and when a host gets picked it, checks its capacity to see if it's below
 // the Average Load per Host.
 //
+// Hosts are placed on a partition-based hash ring (see ring.go) rather than
+// re-walking hash slots on every lookup, so rebalancing on member add/remove
+// is a single distributePartitions pass instead of a per-request fallback.
+//
 // All opertaions in bounded are concurrency-safe.
 //
 // Average Load Per Host is defined as follows:
-// (totalLoad/number_of_hosts)*imbalance_constant
-// totalLoad = sum of all hosts load
-// load = the number of active requests
-// imbalance_constant = is the imbalance constant, which is 1.25 in our case
-// it bounds the load imabalnce to be at most 25% more than (totalLoad/number_of_hosts)
+// ceil((PartitionCount/number_of_hosts)*Load)
+// PartitionCount = the fixed number of partitions the ring is split into
+// Load = the imbalance constant, which is 1.25 by default
+// it bounds the load imabalnce to be at most 25% more than PartitionCount/number_of_hosts
 package bounded
 
 import (
@@ -18,47 +21,306 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lafikl/liblb"
 	"github.com/prometheus/client_golang/prometheus"
-
-	"stathat.com/c/consistent"
 )
 
 var ErrAllOverloaded = errors.New("all hosts are overloaded")
 var Err = errors.New("all hosts are overloaded")
 
+// DefaultCandidateWindow is the number of hosts pulled off the ring and
+// scored against each other when look-aside balancing is enabled.
+const DefaultCandidateWindow = 3
+
+// DefaultEWMADecay is how much weight the latest latency sample gets in the
+// EWMA used by the look-aside cost function.
+const DefaultEWMADecay = 0.2
+
+// DefaultCostWeight is the divisor applied to in-flight requests in the
+// look-aside cost formula, see Config.CostWeight.
+const DefaultCostWeight = 10.0
+
+// DefaultUnavailableTTL is how long a host stays marked unavailable if
+// nothing refreshes its cost metrics.
+const DefaultUnavailableTTL = 30 * time.Second
+
+// DefaultLatencySeed is the initial value of a host's latency EWMA, before
+// any call to Done has reported a real sample. Without a seed a fresh host
+// scores 0 in getLookAside's score, which is always the minimum regardless
+// of how many requests are already in flight to it; seeding it to a small
+// nominal latency means a busy-but-unmeasured host is still ranked behind
+// an idle one once CostWeight is applied.
+const DefaultLatencySeed = time.Millisecond
+
+// Config tunes both the partition ring underneath Bounded and the optional
+// look-aside balancing on top of it. NewWithConfig replaces any zero or
+// negative field (and a nil Hasher) with its default, so the zero value of
+// Config works; DefaultConfig returns those defaults explicitly.
+type Config struct {
+	// PartitionCount is the fixed number of partitions keys are hashed
+	// into. It should stay constant for the lifetime of a ring; only
+	// which member owns each partition changes as membership changes.
+	PartitionCount int
+
+	// ReplicationFactor is how many virtual nodes each member gets on
+	// the hash ring, which controls how evenly partitions spread across
+	// members.
+	ReplicationFactor int
+
+	// Load is the imbalance constant, replacing the hardcoded 1.25:
+	// avgLoad = ceil((PartitionCount/numMembers) * Load).
+	Load float64
+
+	// Hasher hashes member and partition identifiers onto the ring.
+	// Defaults to an internal fnv1a64 if nil.
+	Hasher Hasher
+
+	// LookAside enables cost-aware scoring of the top CandidateWindow
+	// hosts returned by the ring, instead of taking the first one that's
+	// under the bounded-load cap.
+	LookAside bool
+
+	// CandidateWindow is how many hosts are pulled from the consistent
+	// hash ring and scored when LookAside is enabled.
+	CandidateWindow int
+
+	// EWMADecay is the decay factor (0 < alpha <= 1) applied to latency
+	// samples when updating a host's CostMetrics.
+	EWMADecay float64
+
+	// CostWeight is the divisor applied to a host's in-flight request
+	// count in the cost formula: latencyEWMA * (1 + executing/CostWeight).
+	CostWeight float64
+
+	// UnavailableTTL is how long after its last cost update
+	// (MarkUnavailable or Done) a host marked unavailable stays that way
+	// before a background check, run every UnavailableTTL and only when
+	// LookAside is enabled, clears the flag. MarkAvailable clears it at
+	// once.
+	UnavailableTTL time.Duration
+}
+
+// DefaultConfig returns a Config with sane defaults for the partition ring
+// and for look-aside balancing, with LookAside itself left disabled.
+func DefaultConfig() Config {
+	return Config{
+		PartitionCount:    DefaultPartitionCount,
+		ReplicationFactor: DefaultReplicationFactor,
+		Load:              1.25,
+		Hasher:            fnv1a64,
+		LookAside:         false,
+		CandidateWindow:   DefaultCandidateWindow,
+		EWMADecay:         DefaultEWMADecay,
+		CostWeight:        DefaultCostWeight,
+		UnavailableTTL:    DefaultUnavailableTTL,
+	}
+}
+
+// CostMetrics tracks the data used to score a host when look-aside
+// balancing is enabled: an EWMA of its observed service latency, how many
+// requests are currently in-flight to it, and whether it's been marked
+// unavailable.
+type CostMetrics struct {
+	latencyEWMA uint64 // time.Duration bits, read/written via atomic
+	executing   int64
+	lastUpdate  int64 // UnixNano
+	unavailable int32
+}
+
+func newCostMetrics() *CostMetrics {
+	return &CostMetrics{
+		latencyEWMA: uint64(DefaultLatencySeed),
+		lastUpdate:  time.Now().UnixNano(),
+	}
+}
+
+func (c *CostMetrics) latency() time.Duration {
+	return time.Duration(atomic.LoadUint64(&c.latencyEWMA))
+}
+
+func (c *CostMetrics) update(decay float64, latency time.Duration) {
+	prev := time.Duration(atomic.LoadUint64(&c.latencyEWMA))
+	next := time.Duration(decay*float64(latency) + (1-decay)*float64(prev))
+	atomic.StoreUint64(&c.latencyEWMA, uint64(next))
+	atomic.StoreInt64(&c.lastUpdate, time.Now().UnixNano())
+}
+
+func (c *CostMetrics) isUnavailable() bool {
+	return atomic.LoadInt32(&c.unavailable) == 1
+}
+
+// score is latency_ewma * (1 + executing/weight), the cost used to rank
+// candidates during look-aside balancing. Lower is better.
+func (c *CostMetrics) score(weight float64) float64 {
+	executing := float64(atomic.LoadInt64(&c.executing))
+	return float64(c.latency()) * (1 + executing/weight)
+}
+
 type bhost struct {
 	load   uint64
 	weight int
 }
 
 type Bounded struct {
-	ch        *consistent.Consistent
+	ring      *ring
 	loads     map[string]*bhost
+	costs     map[string]*CostMetrics
 	totalLoad uint64
 
+	cfg Config
+
 	enableMetrics bool
 	servedReqs    *prometheus.CounterVec
 	errCounter    *prometheus.CounterVec
+	reqDuration   *prometheus.HistogramVec
+	hostLoad      *prometheus.GaugeVec
+	hostMaxLoad   *prometheus.GaugeVec
+	retries       prometheus.Counter
+
+	ticker   *time.Ticker
+	closeTTL chan struct{}
+	closeOne sync.Once
 
 	sync.RWMutex
 }
 
 func New(hosts ...string) *Bounded {
+	return NewWithConfig(DefaultConfig(), hosts...)
+}
+
+// NewWithConfig is like New but lets the caller tune look-aside balancing,
+// see Config.
+func NewWithConfig(cfg Config, hosts ...string) *Bounded {
+	if cfg.CandidateWindow <= 0 {
+		cfg.CandidateWindow = DefaultCandidateWindow
+	}
+	if cfg.EWMADecay <= 0 {
+		cfg.EWMADecay = DefaultEWMADecay
+	}
+	if cfg.CostWeight <= 0 {
+		cfg.CostWeight = DefaultCostWeight
+	}
+	if cfg.UnavailableTTL <= 0 {
+		cfg.UnavailableTTL = DefaultUnavailableTTL
+	}
+	if cfg.PartitionCount <= 0 {
+		cfg.PartitionCount = DefaultPartitionCount
+	}
+	if cfg.ReplicationFactor <= 0 {
+		cfg.ReplicationFactor = DefaultReplicationFactor
+	}
+	if cfg.Load <= 0 {
+		cfg.Load = 1.25
+	}
+	if cfg.Hasher == nil {
+		cfg.Hasher = fnv1a64
+	}
+
 	c := &Bounded{
-		ch:    consistent.New(),
-		loads: map[string]*bhost{},
+		ring:     newRing(cfg),
+		loads:    map[string]*bhost{},
+		costs:    map[string]*CostMetrics{},
+		cfg:      cfg,
+		closeTTL: make(chan struct{}),
 	}
 	for _, h := range hosts {
 		c.Add(h)
 	}
+
+	// The TTL ticker only clears the look-aside unavailable flag, so it'd
+	// be a goroutine/ticker leak to start it for callers who never asked
+	// for LookAside, since they have no reason to call Close.
+	if cfg.LookAside {
+		c.ticker = time.NewTicker(cfg.UnavailableTTL)
+		go c.clearStaleUnavailable()
+	}
+
 	return c
 }
 
-// Registers "liblb_consistent_bounded_requests_total" and
-// "liblb_consistent_bounded_errors_total" in prometheus.
+// Close stops the background goroutine that clears stale MarkUnavailable
+// flags, if LookAside was enabled. It's safe to call multiple times, and
+// safe to not call at all when LookAside is off.
+func (b *Bounded) Close() {
+	b.closeOne.Do(func() {
+		if b.ticker != nil {
+			b.ticker.Stop()
+		}
+		close(b.closeTTL)
+	})
+}
+
+func (b *Bounded) clearStaleUnavailable() {
+	for {
+		select {
+		case <-b.closeTTL:
+			return
+		case <-b.ticker.C:
+			now := time.Now().UnixNano()
+			b.RLock()
+			for _, cm := range b.costs {
+				if !cm.isUnavailable() {
+					continue
+				}
+				if time.Duration(now-atomic.LoadInt64(&cm.lastUpdate)) >= b.cfg.UnavailableTTL {
+					atomic.StoreInt32(&cm.unavailable, 0)
+				}
+			}
+			b.RUnlock()
+		}
+	}
+}
+
+// MarkUnavailable flags host so look-aside balancing skips it until
+// MarkAvailable is called or, when Config.LookAside is enabled,
+// Config.UnavailableTTL passes without a cost update for it.
+func (b *Bounded) MarkUnavailable(host string) {
+	b.RLock()
+	defer b.RUnlock()
+
+	cm, ok := b.costs[host]
+	if !ok {
+		return
+	}
+	atomic.StoreInt32(&cm.unavailable, 1)
+	atomic.StoreInt64(&cm.lastUpdate, time.Now().UnixNano())
+}
+
+// MarkAvailable clears a previous MarkUnavailable for host.
+func (b *Bounded) MarkAvailable(host string) {
+	b.RLock()
+	defer b.RUnlock()
+
+	cm, ok := b.costs[host]
+	if !ok {
+		return
+	}
+	atomic.StoreInt32(&cm.unavailable, 0)
+}
+
+// EnableMetrics registers the Bounded's metrics (see EnableMetricsWith) on
+// prometheus.DefaultRegisterer. Prefer EnableMetricsWith when running more
+// than one Bounded in the same process, since two instances registering
+// against the default registry collide with AlreadyRegisteredError.
 func (c *Bounded) EnableMetrics() error {
+	return c.EnableMetricsWith(prometheus.DefaultRegisterer)
+}
+
+// EnableMetricsWith registers the Bounded's metrics on reg instead of the
+// global default registry:
+//
+//   - liblb_consistent_bounded_requests_total (CounterVec, by host)
+//   - liblb_consistent_bounded_errors_total (CounterVec, by error type)
+//   - liblb_consistent_bounded_request_duration_seconds (HistogramVec, by
+//     host, fed from Done)
+//   - liblb_consistent_bounded_host_load (GaugeVec, by host)
+//   - liblb_consistent_bounded_host_max_load (GaugeVec, by host)
+//   - liblb_consistent_bounded_get_retries_total (Counter, incremented each
+//     time get()'s bounded-load scan skips an overloaded candidate)
+func (c *Bounded) EnableMetricsWith(reg prometheus.Registerer) error {
 	c.Lock()
 	defer c.Unlock()
 
@@ -67,28 +329,66 @@ func (c *Bounded) EnableMetrics() error {
 		Help: "Number of requests served by Consistent Bounded",
 	}, []string{"host"})
 
-	err := prometheus.Register(sreq)
-	if err != nil {
-		return err
-	}
-
 	errCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "liblb_consistent_bounded_errors_total",
 		Help: "Number of times Bounded failed",
 	}, []string{"type"})
 
-	err = prometheus.Register(errCounter)
-	if err != nil {
-		return err
+	reqDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "liblb_consistent_bounded_request_duration_seconds",
+		Help: "Observed service latency reported to Done, by host",
+	}, []string{"host"})
+
+	hostLoad := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "liblb_consistent_bounded_host_load",
+		Help: "Current in-flight load per host",
+	}, []string{"host"})
+
+	hostMaxLoad := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "liblb_consistent_bounded_host_max_load",
+		Help: "Current max load per host, i.e. AvgLoad()*weight",
+	}, []string{"host"})
+
+	retries := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "liblb_consistent_bounded_get_retries_total",
+		Help: "Number of times get() skipped an overloaded candidate host",
+	})
+
+	collectors := []prometheus.Collector{sreq, errCounter, reqDuration, hostLoad, hostMaxLoad, retries}
+	for i, collector := range collectors {
+		if err := reg.Register(collector); err != nil {
+			for _, registered := range collectors[:i] {
+				reg.Unregister(registered)
+			}
+			return err
+		}
 	}
 
 	c.servedReqs = sreq
 	c.errCounter = errCounter
+	c.reqDuration = reqDuration
+	c.hostLoad = hostLoad
+	c.hostMaxLoad = hostMaxLoad
+	c.retries = retries
 	c.enableMetrics = true
 
+	c.updateMaxLoadGaugeLocked()
+
 	return nil
 }
 
+// updateMaxLoadGaugeLocked refreshes the host_max_load gauge for every
+// member. Called with the lock held, whenever membership or weights change.
+func (c *Bounded) updateMaxLoadGaugeLocked() {
+	if !c.enableMetrics {
+		return
+	}
+	avg := c.avgLoad()
+	for host, bh := range c.loads {
+		c.hostMaxLoad.WithLabelValues(host).Set(avg * float64(bh.weight))
+	}
+}
+
 func (b *Bounded) Add(host string) {
 	b.AddWeight(host, 1)
 }
@@ -104,7 +404,9 @@ func (b *Bounded) AddWeight(host string, weight int) {
 	}
 
 	b.loads[host] = &bhost{load: 0, weight: weight}
-	b.ch.Add(host)
+	b.costs[host] = newCostMetrics()
+	b.ring.Add(host)
+	b.updateMaxLoadGaugeLocked()
 }
 
 func (b *Bounded) Remove(host string) {
@@ -119,7 +421,16 @@ func (b *Bounded) Remove(host string) {
 	b.totalLoad -= load.load
 
 	delete(b.loads, host)
-	b.ch.Remove(host)
+	delete(b.costs, host)
+	b.ring.Remove(host)
+
+	if b.enableMetrics {
+		b.hostLoad.DeleteLabelValues(host)
+		b.hostMaxLoad.DeleteLabelValues(host)
+		b.reqDuration.DeleteLabelValues(host)
+		b.servedReqs.DeleteLabelValues(host)
+	}
+	b.updateMaxLoadGaugeLocked()
 }
 
 // err can be either liblb.ErrNoHost if there's no added hosts.
@@ -130,11 +441,15 @@ func (b *Bounded) Balance(key string) (host string, err error) {
 	b.Lock()
 	defer b.Unlock()
 
-	if len(b.ch.Members()) == 0 {
+	if len(b.loads) == 0 {
 		return "", liblb.ErrNoHost
 	}
 
-	host, err = b.get("", key, 10)
+	if b.cfg.LookAside {
+		host, err = b.getLookAside(key)
+	} else {
+		host, err = b.get(key)
+	}
 	if err != nil {
 		if b.enableMetrics {
 			b.updateErrCount(err)
@@ -157,31 +472,88 @@ func (b *Bounded) updateErrCount(err error) {
 	b.errCounter.WithLabelValues(typ).Inc()
 }
 
-func (b *Bounded) get(firstKey, currentKey string, size int) (string, error) {
-	hosts, err := b.ch.GetN(currentKey, size)
+// get locates key's partition owner and, if it's over its bounded-load cap,
+// walks the rest of its closest-N candidates on the ring looking for one
+// that isn't. Unlike the old stathat-ring based implementation this never
+// recurses: getClosestN(key, len(b.loads)) already covers every member.
+func (b *Bounded) get(key string) (string, error) {
+	hosts, err := b.ring.getClosestN(key, len(b.loads))
 	if err != nil {
 		return "", err
 	}
 
 	for _, host := range hosts {
-		if host == firstKey {
-			return "", ErrAllOverloaded
-		}
 		if b.loadOK(host) {
-			b.loads[host].load++
-			b.totalLoad++
+			b.reserve(host)
 			return host, nil
 		}
+		if b.enableMetrics {
+			b.retries.Inc()
+		}
 	}
-	if len(firstKey) == 0 {
-		firstKey = hosts[0]
+	return "", ErrAllOverloaded
+}
+
+// reserve records a request being sent to host: bumps its load counters,
+// its in-flight CostMetrics.executing (consumed by Done and by
+// getLookAside's scoring), and, if enabled, the host_load gauge. Every path
+// that hands out a host, look-aside or not, must go through this so
+// CostMetrics.executing stays in sync with Done's decrements.
+func (b *Bounded) reserve(host string) {
+	b.loads[host].load++
+	b.totalLoad++
+	if cm, ok := b.costs[host]; ok {
+		atomic.AddInt64(&cm.executing, 1)
+	}
+	if b.enableMetrics {
+		b.hostLoad.WithLabelValues(host).Set(float64(b.loads[host].load))
 	}
-	currentKey = hosts[len(hosts)-1]
-	// return b.get(firstKey, currentKey, size*3/2)
-	return b.get(firstKey, currentKey, size)
 }
 
-func (b *Bounded) Done(host string) {
+// getLookAside pulls the top CandidateWindow hosts for key off the ring,
+// drops any marked unavailable, and picks the cheapest by CostMetrics.score.
+// The bounded-load cap still applies: among the scored candidates only the
+// ones under their max load are eligible, and if none qualify it falls back
+// to the plain get(), which ignores the unavailable flag, so the request is
+// still placed.
+func (b *Bounded) getLookAside(key string) (string, error) {
+	hosts, err := b.ring.getClosestN(key, b.cfg.CandidateWindow)
+	if err != nil {
+		return "", err
+	}
+
+	best := ""
+	bestScore := math.Inf(1)
+	for _, host := range hosts {
+		cm, ok := b.costs[host]
+		if !ok || cm.isUnavailable() {
+			continue
+		}
+		if !b.loadOK(host) {
+			continue
+		}
+		s := cm.score(b.cfg.CostWeight)
+		if s < bestScore {
+			best = host
+			bestScore = s
+		}
+	}
+
+	if best == "" {
+		return b.get(key)
+	}
+
+	b.reserve(best)
+	return best, nil
+}
+
+// Done marks a request to host as finished. latency is used to update the
+// host's cost metrics (EWMA) for look-aside balancing. If err is non-nil
+// and EnableMetrics/EnableMetricsWith was called, it's counted in
+// liblb_consistent_bounded_errors_total{type="downstream"}; Done does not
+// by itself mark the host unavailable, callers should call MarkUnavailable
+// for that.
+func (b *Bounded) Done(host string, latency time.Duration, err error) {
 	b.Lock()
 	defer b.Unlock()
 
@@ -191,6 +563,23 @@ func (b *Bounded) Done(host string) {
 	}
 	bhost.load--
 	b.totalLoad--
+
+	if b.enableMetrics {
+		b.reqDuration.WithLabelValues(host).Observe(latency.Seconds())
+		b.hostLoad.WithLabelValues(host).Set(float64(bhost.load))
+		if err != nil {
+			b.errCounter.WithLabelValues("downstream").Inc()
+		}
+	}
+
+	cm, ok := b.costs[host]
+	if !ok {
+		return
+	}
+	cm.update(b.cfg.EWMADecay, latency)
+	if atomic.LoadInt64(&cm.executing) > 0 {
+		atomic.AddInt64(&cm.executing, -1)
+	}
 }
 
 func (b *Bounded) Loads() map[string]uint64 {
@@ -210,16 +599,7 @@ func (b *Bounded) Weights() map[string]uint64 {
 }
 
 func (b *Bounded) loadOK(host string) bool {
-	// calcs load
-	if b.totalLoad == 0 {
-		b.totalLoad = 1
-	}
-	var avgLoadPerNode float64
-	avgLoadPerNode = float64(b.totalLoad / uint64(len(b.loads)))
-	if avgLoadPerNode == 0 {
-		avgLoadPerNode = 1
-	}
-	avgLoadPerNode = math.Ceil(avgLoadPerNode * 1.25)
+	avgLoadPerNode := b.avgLoad()
 
 	bhost, ok := b.loads[host]
 	if !ok {
@@ -234,22 +614,25 @@ func (b *Bounded) loadOK(host string) bool {
 }
 
 // Average Load Per Host is:
-// (totalLoad/number_of_hosts)*imbalance_constant
-// totalLoad = sum of all hosts load
-// load = the number of active requests
-// imbalance_constant = is the imbalance constant, which is 1.25 in our case
-// it bounds the load imabalnce to be at most 25% more than (totalLoad/number_of_hosts)
+// ceil((PartitionCount/number_of_hosts) * Load)
+// PartitionCount = the fixed number of partitions the ring is split into
+// Load = the imbalance constant, 1.25 by default
+// it bounds the load imabalnce to be at most 25% more than PartitionCount/number_of_hosts
 func (b *Bounded) AvgLoad() uint64 {
 	b.Lock()
 	defer b.Unlock()
 
-	var avgLoadPerNode float64
-	avgLoadPerNode = float64(b.totalLoad / uint64(len(b.loads)))
-	if avgLoadPerNode == 0 {
-		avgLoadPerNode = 1
+	return uint64(b.avgLoad())
+}
+
+// avgLoad is AvgLoad without locking, for callers that already hold the
+// lock (loadOK).
+func (b *Bounded) avgLoad() float64 {
+	if len(b.loads) == 0 {
+		return 0
 	}
-	avgLoadPerNode = math.Ceil(avgLoadPerNode * 1.25)
-	return uint64(avgLoadPerNode)
+	avgLoadPerNode := float64(b.cfg.PartitionCount) / float64(len(b.loads))
+	return math.Ceil(avgLoadPerNode * b.cfg.Load)
 }
 
 // Max load of a host is (Average Load Per Host*Host Weight)
@@ -264,3 +647,16 @@ func (b *Bounded) MaxLoad(host string) uint64 {
 	}
 	return avg * uint64(bh.weight)
 }
+
+// LocateKey returns the host key would be placed on without reserving any
+// load capacity, so callers can inspect ring placement without affecting
+// bounded-load accounting.
+func (b *Bounded) LocateKey(key string) (string, error) {
+	return b.ring.LocateKey(key)
+}
+
+// GetClosestN returns the n hosts closest to key on the ring, in ring
+// order, without reserving any load capacity.
+func (b *Bounded) GetClosestN(key string, n int) ([]string, error) {
+	return b.ring.getClosestN(key, n)
+}
@@ -0,0 +1,101 @@
+package bounded
+
+import (
+	"testing"
+	"time"
+)
+
+func newLookAsideBounded(hosts ...string) *Bounded {
+	cfg := DefaultConfig()
+	cfg.LookAside = true
+	cfg.CandidateWindow = len(hosts)
+	return NewWithConfig(cfg, hosts...)
+}
+
+func TestGetLookAsidePrefersLowerCostHost(t *testing.T) {
+	b := newLookAsideBounded("a", "b", "c")
+	defer b.Close()
+
+	// decay=1 makes update() overwrite the EWMA outright, so these are
+	// exact rather than approximate.
+	b.costs["a"].update(1, 100*time.Millisecond)
+	b.costs["b"].update(1, time.Millisecond)
+	b.costs["c"].update(1, 50*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		host, err := b.Balance("any-key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host != "b" {
+			t.Fatalf("Balance picked %q, want the lowest-latency host %q", host, "b")
+		}
+		b.Done(host, time.Millisecond, nil)
+	}
+}
+
+func TestGetLookAsideSkipsUnavailableHost(t *testing.T) {
+	b := newLookAsideBounded("a", "b")
+	defer b.Close()
+
+	// b has the lower latency but is marked unavailable, so a must win.
+	b.costs["a"].update(1, 10*time.Millisecond)
+	b.costs["b"].update(1, time.Millisecond)
+	b.MarkUnavailable("b")
+
+	host, err := b.Balance("any-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "a" {
+		t.Fatalf("Balance picked %q, want %q since b is unavailable", host, "a")
+	}
+
+	b.MarkAvailable("b")
+	host, err = b.Balance("any-key-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "b" {
+		t.Fatalf("Balance picked %q after MarkAvailable, want %q", host, "b")
+	}
+}
+
+func TestGetLookAsideFallsBackWhenAllUnavailable(t *testing.T) {
+	b := newLookAsideBounded("a", "b")
+	defer b.Close()
+
+	b.MarkUnavailable("a")
+	b.MarkUnavailable("b")
+
+	host, err := b.Balance("any-key")
+	if err != nil {
+		t.Fatalf("expected get() fallback to still place the request, got error: %v", err)
+	}
+	if host != "a" && host != "b" {
+		t.Fatalf("got unexpected host %q", host)
+	}
+}
+
+func TestCostMetricsExecutingTrackedThroughFallback(t *testing.T) {
+	b := newLookAsideBounded("a")
+	defer b.Close()
+
+	// The only host is unavailable, so getLookAside must fall back to
+	// get(), which still needs to bump CostMetrics.executing for scoring
+	// to stay in sync with Done's decrement.
+	b.MarkUnavailable("a")
+
+	host, err := b.Balance("any-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.costs[host].executing; got != 1 {
+		t.Fatalf("executing = %d after Balance via fallback, want 1", got)
+	}
+
+	b.Done(host, time.Millisecond, nil)
+	if got := b.costs[host].executing; got != 0 {
+		t.Fatalf("executing = %d after Done, want 0", got)
+	}
+}
@@ -0,0 +1,51 @@
+package bounded
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEnableMetricsWithUsesGivenRegistry(t *testing.T) {
+	b := New("a", "b")
+	reg := prometheus.NewRegistry()
+
+	if err := b.EnableMetricsWith(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	other := New("c")
+	if err := other.EnableMetricsWith(prometheus.NewRegistry()); err != nil {
+		t.Fatalf("a second Bounded on its own registry should register cleanly, got: %v", err)
+	}
+
+	if err := other.EnableMetricsWith(reg); err == nil {
+		t.Fatal("expected registering a second Bounded's metrics on an already-used registry to fail")
+	}
+}
+
+func TestMetricsSurviveAddRemoveAddCycle(t *testing.T) {
+	b := New("a", "b")
+	if err := b.EnableMetricsWith(prometheus.NewRegistry()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		host, err := b.Balance("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Done(host, time.Millisecond, nil)
+	}
+
+	b.Remove("a")
+	b.Add("a")
+
+	host, err := b.Balance("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Done(host, time.Millisecond, errors.New("downstream failure"))
+}
@@ -0,0 +1,181 @@
+package bounded
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// ErrNotEnoughHosts is returned by PlaceReplicas when fewer than the
+// requested replica count are registered with the Bounded's ring.
+var ErrNotEnoughHosts = errors.New("not enough hosts for the requested replica count")
+
+// Move describes a single piece of placement work: key needs to move off
+// of From and onto To. From is empty for a key that's being placed for the
+// first time.
+type Move struct {
+	Key  string
+	From string
+	To   string
+}
+
+// Planner sits on top of a Bounded and turns its ring/weights into replica
+// placement decisions, for callers that use Bounded to place shards, cached
+// blobs, or sticky sessions rather than to load-balance individual
+// requests. It shares the Bounded's ring and load accounting rather than
+// keeping its own, so it always reflects the current membership.
+type Planner struct {
+	b *Bounded
+
+	// MaxMovesPerHost caps how many moves Plan will schedule with a
+	// given host as the destination in one call, so a membership change
+	// can be paced across several Plan calls instead of moving
+	// everything at once. Zero means unbounded.
+	MaxMovesPerHost int
+}
+
+// NewPlanner returns a Planner backed by b.
+func NewPlanner(b *Bounded) *Planner {
+	return &Planner{b: b}
+}
+
+// PlaceReplicas returns r distinct hosts for key, honoring both the ring
+// order and the bounded-load cap: it's GetClosestN filtered down to hosts
+// that are currently under their max load, falling back to the plain ring
+// order for any slots that can't be filled without overloading a host.
+func (p *Planner) PlaceReplicas(key string, r int) ([]string, error) {
+	p.b.Lock()
+	defer p.b.Unlock()
+
+	if r > len(p.b.loads) {
+		return nil, ErrNotEnoughHosts
+	}
+
+	candidates, err := p.b.ring.getClosestN(key, len(p.b.loads))
+	if err != nil {
+		return nil, err
+	}
+
+	placed := make([]string, 0, r)
+	overflow := make([]string, 0, r)
+	for _, host := range candidates {
+		if len(placed) == r {
+			break
+		}
+		if p.b.loadOK(host) {
+			placed = append(placed, host)
+		} else {
+			overflow = append(overflow, host)
+		}
+	}
+	for i := 0; len(placed) < r && i < len(overflow); i++ {
+		placed = append(placed, overflow[i])
+	}
+
+	return placed, nil
+}
+
+// Plan diffs prevAssignment (key -> currently assigned hosts) against where
+// each of those keys would be placed on the ring now, and returns the
+// minimum set of moves needed to bring the assignment in line. Target fill
+// per host is sized proportionally to its weight, and at most
+// MaxMovesPerHost moves are scheduled per destination host so a large
+// membership change can be paced across repeated calls to Plan.
+func (p *Planner) Plan(prevAssignment map[string][]string) []Move {
+	p.b.RLock()
+	defer p.b.RUnlock()
+
+	total := 0
+	fill := map[string]int{}
+	for _, hosts := range prevAssignment {
+		total += len(hosts)
+		for _, h := range hosts {
+			fill[h]++
+		}
+	}
+
+	keys := make([]string, 0, len(prevAssignment))
+	for key := range prevAssignment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	movesToHost := map[string]int{}
+	var moves []Move
+
+	for _, key := range keys {
+		prevHosts := prevAssignment[key]
+		wanted, err := p.b.ring.getClosestN(key, len(prevHosts))
+		if err != nil {
+			continue
+		}
+
+		prevSet := make(map[string]bool, len(prevHosts))
+		for _, h := range prevHosts {
+			prevSet[h] = true
+		}
+		wantSet := make(map[string]bool, len(wanted))
+		for _, h := range wanted {
+			wantSet[h] = true
+		}
+
+		missing := make([]string, 0)
+		for _, h := range wanted {
+			if !prevSet[h] {
+				missing = append(missing, h)
+			}
+		}
+		stale := make([]string, 0)
+		for _, h := range prevHosts {
+			if !wantSet[h] {
+				stale = append(stale, h)
+			}
+		}
+
+		for i := 0; i < len(missing) && i < len(stale); i++ {
+			to, from := missing[i], stale[i]
+			if p.MaxMovesPerHost > 0 && movesToHost[to] >= p.MaxMovesPerHost {
+				continue
+			}
+			if limit, ok := p.targetFill(to, total); ok && fill[to] >= limit {
+				continue
+			}
+			moves = append(moves, Move{Key: key, From: from, To: to})
+			movesToHost[to]++
+			fill[to]++
+			fill[from]--
+		}
+	}
+
+	return moves
+}
+
+// targetFill returns how many keys host should end up holding out of total
+// placements, sized proportionally to its weight relative to the sum of all
+// weights, rounded up so a host with any share of the weight still gets a
+// cap of at least 1 instead of always blocking its first move. Plan uses
+// this to throttle moves onto hosts that have already reached their
+// weight-proportional share, instead of spreading keys evenly regardless of
+// weight. ok is false if host is unknown or the weight sum is zero, in
+// which case there's nothing meaningful to throttle against and Plan
+// should treat the move as uncapped. Callers must already hold p.b's lock.
+func (p *Planner) targetFill(host string, total int) (limit int, ok bool) {
+	bh, ok := p.b.loads[host]
+	if !ok {
+		return 0, false
+	}
+
+	var weightSum int
+	for _, h := range p.b.loads {
+		weightSum += h.weight
+	}
+	if weightSum == 0 {
+		return 0, false
+	}
+
+	target := int(math.Ceil(float64(total) * float64(bh.weight) / float64(weightSum)))
+	if target < 1 {
+		target = 1
+	}
+	return target, true
+}
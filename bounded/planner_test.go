@@ -0,0 +1,154 @@
+package bounded
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPlanStableAssignmentNoMoves(t *testing.T) {
+	b := New("a", "b", "c")
+	p := NewPlanner(b)
+
+	prev := map[string][]string{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		hosts, err := b.GetClosestN(key, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev[key] = hosts
+	}
+
+	moves := p.Plan(prev)
+	if len(moves) != 0 {
+		t.Fatalf("got %d moves for an assignment that already matches the ring, want 0: %v", len(moves), moves)
+	}
+}
+
+func TestPlanMovesStaleKeysOntoNewHost(t *testing.T) {
+	b := New("a", "b")
+	p := NewPlanner(b)
+
+	prev := map[string][]string{"some-key": {"a", "b"}}
+	b.Add("c")
+
+	wanted, err := b.GetClosestN("some-key", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(wanted, prev["some-key"]) {
+		t.Skip("adding c didn't change placement for this key, nothing to plan")
+	}
+
+	moves := p.Plan(prev)
+	if len(moves) == 0 {
+		t.Fatal("expected at least one move after adding a host that the ring now prefers, got none")
+	}
+	for _, mv := range moves {
+		if mv.To != "c" {
+			continue
+		}
+		found := false
+		for _, h := range prev[mv.Key] {
+			if h == mv.From {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("move %+v claims to move off a host that wasn't in the previous assignment", mv)
+		}
+	}
+}
+
+func TestPlanIsDeterministic(t *testing.T) {
+	b := New("a", "b", "c", "d")
+	p := NewPlanner(b)
+
+	prev := map[string][]string{}
+	for i := 0; i < 30; i++ {
+		prev[fmt.Sprintf("key-%d", i)] = []string{"a", "b"}
+	}
+
+	first := p.Plan(prev)
+	for i := 0; i < 5; i++ {
+		again := p.Plan(prev)
+		if !reflect.DeepEqual(first, again) {
+			t.Fatalf("Plan returned different results across runs:\n%v\n%v", first, again)
+		}
+	}
+}
+
+func TestPlanRespectsMaxMovesPerHost(t *testing.T) {
+	b := New("a")
+	p := NewPlanner(b)
+	p.MaxMovesPerHost = 2
+
+	prev := map[string][]string{}
+	for i := 0; i < 10; i++ {
+		prev[fmt.Sprintf("key-%d", i)] = []string{"a"}
+	}
+	b.Add("b")
+
+	moves := p.Plan(prev)
+	toB := 0
+	for _, mv := range moves {
+		if mv.To == "b" {
+			toB++
+		}
+	}
+	if toB > p.MaxMovesPerHost {
+		t.Fatalf("got %d moves onto b, want at most MaxMovesPerHost=%d", toB, p.MaxMovesPerHost)
+	}
+}
+
+func TestTargetFillRoundsUpForSmallShares(t *testing.T) {
+	b := New("a", "b", "c")
+	p := NewPlanner(b)
+
+	limit, ok := p.targetFill("a", 2)
+	if !ok {
+		t.Fatal("expected targetFill to report ok=true for a known host with nonzero weight sum")
+	}
+	if limit < 1 {
+		t.Fatalf("targetFill(a, 2) with 3 equal-weight hosts = %d, want >= 1", limit)
+	}
+}
+
+func TestTargetFillUnknownHost(t *testing.T) {
+	b := New("a", "b")
+	p := NewPlanner(b)
+
+	if _, ok := p.targetFill("nope", 10); ok {
+		t.Fatal("expected ok=false for a host that was never added")
+	}
+}
+
+func TestPlaceReplicasReturnsDistinctHosts(t *testing.T) {
+	b := New("a", "b", "c", "d")
+	p := NewPlanner(b)
+
+	hosts, err := p.PlaceReplicas("some-key", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 3 {
+		t.Fatalf("got %d hosts, want 3", len(hosts))
+	}
+	seen := map[string]bool{}
+	for _, h := range hosts {
+		if seen[h] {
+			t.Fatalf("PlaceReplicas returned duplicate host %q: %v", h, hosts)
+		}
+		seen[h] = true
+	}
+}
+
+func TestPlaceReplicasNotEnoughHosts(t *testing.T) {
+	b := New("a", "b")
+	p := NewPlanner(b)
+
+	if _, err := p.PlaceReplicas("some-key", 3); err != ErrNotEnoughHosts {
+		t.Fatalf("got err=%v, want ErrNotEnoughHosts", err)
+	}
+}
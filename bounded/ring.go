@@ -0,0 +1,211 @@
+package bounded
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/lafikl/liblb"
+)
+
+// Hasher hashes data into a 64-bit value used to place both members and
+// partitions on the ring. Callers that care about distribution quality
+// should supply something like xxhash or fnv1a; fnv1a64 is used if none is
+// given.
+type Hasher func(data []byte) uint64
+
+// DefaultPartitionCount is used when Config.PartitionCount is left unset.
+// It's a prime comfortably larger than any realistic member count, so
+// partitions spread evenly across members.
+const DefaultPartitionCount = 271
+
+// DefaultReplicationFactor is used when Config.ReplicationFactor is left
+// unset. It's how many virtual nodes each member gets on the ring.
+const DefaultReplicationFactor = 20
+
+// ring is a partition-based consistent hash: PartitionCount fixed
+// partitions are distributed across members placed on a hash ring via
+// ReplicationFactor virtual nodes each. Partition ownership is
+// recalculated only when membership changes, so LocateKey/getClosestN are
+// plain map/slice lookups rather than a walk that can recurse.
+type ring struct {
+	mu sync.RWMutex
+
+	hasher            Hasher
+	partitionCount    int
+	replicationFactor int
+
+	members    map[string]bool
+	sortedSet  []uint64
+	vnodes     map[uint64]string
+	partitions map[int]string
+}
+
+func newRing(cfg Config) *ring {
+	return &ring{
+		hasher:            cfg.Hasher,
+		partitionCount:    cfg.PartitionCount,
+		replicationFactor: cfg.ReplicationFactor,
+		members:           map[string]bool{},
+		vnodes:            map[uint64]string{},
+		partitions:        map[int]string{},
+	}
+}
+
+func (r *ring) Members() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	members := make([]string, 0, len(r.members))
+	for m := range r.members {
+		members = append(members, m)
+	}
+	return members
+}
+
+func (r *ring) Add(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.members[member] {
+		return
+	}
+	r.members[member] = true
+
+	for i := 0; i < r.replicationFactor; i++ {
+		h := r.hasher(vnodeKey(member, i))
+		r.vnodes[h] = member
+		r.sortedSet = append(r.sortedSet, h)
+	}
+	sort.Slice(r.sortedSet, func(i, j int) bool { return r.sortedSet[i] < r.sortedSet[j] })
+
+	r.distributePartitions()
+}
+
+func (r *ring) Remove(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.members[member] {
+		return
+	}
+	delete(r.members, member)
+
+	kept := r.sortedSet[:0]
+	for _, h := range r.sortedSet {
+		if r.vnodes[h] == member {
+			delete(r.vnodes, h)
+			continue
+		}
+		kept = append(kept, h)
+	}
+	r.sortedSet = kept
+
+	r.distributePartitions()
+}
+
+// distributePartitions assigns each of the PartitionCount partitions to the
+// member closest to it on the ring. It's O(PartitionCount*log(vnodes)) and
+// runs once per membership change, so lookups afterwards are O(1)/O(log n).
+func (r *ring) distributePartitions() {
+	if len(r.sortedSet) == 0 {
+		r.partitions = map[int]string{}
+		return
+	}
+
+	partitions := make(map[int]string, r.partitionCount)
+	for p := 0; p < r.partitionCount; p++ {
+		h := r.hasher(partitionKey(p))
+		partitions[p] = r.vnodes[r.sortedSet[r.search(h)]]
+	}
+	r.partitions = partitions
+}
+
+// search returns the index in sortedSet of the first vnode hash >= h,
+// wrapping around to 0 if h is past the last one.
+func (r *ring) search(h uint64) int {
+	idx := sort.Search(len(r.sortedSet), func(i int) bool { return r.sortedSet[i] >= h })
+	if idx >= len(r.sortedSet) {
+		idx = 0
+	}
+	return idx
+}
+
+func (r *ring) partitionFor(key string) int {
+	return int(r.hasher([]byte(key)) % uint64(r.partitionCount))
+}
+
+// LocateKey returns the owner of key's partition without walking the ring.
+func (r *ring) LocateKey(key string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.members) == 0 {
+		return "", liblb.ErrNoHost
+	}
+	return r.partitions[r.partitionFor(key)], nil
+}
+
+// getClosestN returns the n distinct members closest to key's partition on
+// the ring, in ring order starting at the partition owner.
+func (r *ring) getClosestN(key string, n int) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.members) == 0 {
+		return nil, liblb.ErrNoHost
+	}
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+
+	h := r.hasher(partitionKey(r.partitionFor(key)))
+	start := r.search(h)
+
+	seen := make(map[string]bool, n)
+	res := make([]string, 0, n)
+	for i := 0; len(res) < n; i++ {
+		idx := (start + i) % len(r.sortedSet)
+		m := r.vnodes[r.sortedSet[idx]]
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func vnodeKey(member string, replica int) []byte {
+	b := make([]byte, len(member)+4)
+	copy(b, member)
+	binary.BigEndian.PutUint32(b[len(member):], uint32(replica))
+	return b
+}
+
+func partitionKey(partition int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(partition))
+	return b
+}
+
+// fnv1a64 is the default Hasher, used when Config.Hasher is nil. It's
+// FNV-1a followed by a 64-bit finalizer, so inputs that differ only in
+// their last bytes (partition and vnode keys) still spread across the
+// whole ring instead of landing next to each other.
+func fnv1a64(data []byte) uint64 {
+	const offset64 = 14695981039346656037
+	const prime64 = 1099511628211
+
+	h := uint64(offset64)
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= prime64
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
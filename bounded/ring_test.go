@@ -0,0 +1,120 @@
+package bounded
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testRingConfig() Config {
+	cfg := DefaultConfig()
+	cfg.PartitionCount = 53
+	cfg.ReplicationFactor = 10
+	return cfg
+}
+
+func TestRingDistributePartitionsCoversAll(t *testing.T) {
+	r := newRing(testRingConfig())
+	for _, m := range []string{"a", "b", "c", "d"} {
+		r.Add(m)
+	}
+
+	if len(r.partitions) != r.partitionCount {
+		t.Fatalf("got %d partitions, want %d", len(r.partitions), r.partitionCount)
+	}
+	for p, owner := range r.partitions {
+		if !r.members[owner] {
+			t.Fatalf("partition %d owned by %q, which isn't a member", p, owner)
+		}
+	}
+}
+
+func TestRingLocateKeyMatchesClosestN(t *testing.T) {
+	r := newRing(testRingConfig())
+	for _, m := range []string{"a", "b", "c", "d", "e"} {
+		r.Add(m)
+	}
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		owner, err := r.LocateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		closest, err := r.getClosestN(key, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if closest[0] != owner {
+			t.Fatalf("LocateKey(%q)=%q, getClosestN(%q,1)[0]=%q", key, owner, key, closest[0])
+		}
+	}
+}
+
+func TestRingGetClosestNDistinctAndWraps(t *testing.T) {
+	r := newRing(testRingConfig())
+	members := []string{"a", "b", "c", "d", "e"}
+	for _, m := range members {
+		r.Add(m)
+	}
+
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("wrap-key-%d", i)
+		hosts, err := r.getClosestN(key, len(members))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != len(members) {
+			t.Fatalf("getClosestN(%q, %d) returned %d hosts", key, len(members), len(hosts))
+		}
+		seen := map[string]bool{}
+		for _, h := range hosts {
+			if seen[h] {
+				t.Fatalf("getClosestN(%q) returned duplicate host %q: %v", key, h, hosts)
+			}
+			seen[h] = true
+		}
+	}
+}
+
+func TestRingGetClosestNCapsAtMemberCount(t *testing.T) {
+	r := newRing(testRingConfig())
+	r.Add("only-member")
+
+	hosts, err := r.getClosestN("some-key", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("got %d hosts with 1 member and n=10, want 1", len(hosts))
+	}
+}
+
+func TestRingRemoveRedistributes(t *testing.T) {
+	r := newRing(testRingConfig())
+	for _, m := range []string{"a", "b", "c"} {
+		r.Add(m)
+	}
+	r.Remove("b")
+
+	if r.members["b"] {
+		t.Fatal("b should no longer be a member")
+	}
+	for p, owner := range r.partitions {
+		if owner == "b" {
+			t.Fatalf("partition %d still owned by removed member b", p)
+		}
+	}
+}
+
+func TestRingEmptyReturnsErrNoHost(t *testing.T) {
+	r := newRing(testRingConfig())
+
+	if _, err := r.LocateKey("key"); err == nil {
+		t.Fatal("expected error from LocateKey on empty ring")
+	}
+	if _, err := r.getClosestN("key", 1); err == nil {
+		t.Fatal("expected error from getClosestN on empty ring")
+	}
+}